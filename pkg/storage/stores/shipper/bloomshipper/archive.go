@@ -0,0 +1,173 @@
+package bloomshipper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+// pipeBufPool pools the bufio.Writer used to batch writes from the
+// background archiving goroutine into the io.Pipe, avoiding a fresh
+// allocation per block archived.
+var pipeBufPool = sync.Pool{
+	New: func() any {
+		return bufio.NewWriterSize(nil, 32*1024)
+	},
+}
+
+// Note: the gzip.Writer and tar.Header allocations for the archive itself
+// happen inside v1.TarGz, in the pkg/storage/bloom/v1 package, not in this
+// file. Pooling them requires changing TarGz's signature to accept a
+// reusable writer/header, which also means updating every other caller of
+// TarGz across the tree (e.g. the compactor) -- out of scope for this
+// change. pipeBufPool above is the allocation this package does control per
+// block archived.
+
+// seekless is implemented by Block.Data readers that are already positioned
+// at the start and don't need (or benefit from) being rewound via Seek
+// before upload. PutBlock uses this to skip the defensive Seek(0, 0) call
+// for object clients that accept a plain io.Reader.
+type seekless interface {
+	SeekNotRequired() bool
+}
+
+// streamingBlockData is an io.ReadSeekCloser backed by an io.Pipe fed by a
+// background goroutine running v1.TarGz. This avoids buffering the entire
+// archived+compressed block in memory, which matters during compaction
+// where hundreds of blocks may be archived concurrently.
+//
+// Most object clients either accept a plain io.Reader for PutObject, or
+// only Seek back to the start once (e.g. to compute a retry body) before
+// ever reading. To serve that cheaply, streamingBlockData reads directly
+// from the pipe until Seek is actually called, at which point it spills the
+// remainder of the archive to a temp file and continues from there. A Seek
+// called after data has already been read -- e.g. an object client retrying
+// a PUT partway through -- can't be served from the now-partially-drained
+// pipe, so it instead re-runs the archive from scratch into a fresh spill
+// file, trading a re-archive for correctness rather than failing the
+// upload outright.
+type streamingBlockData struct {
+	// archive writes the archive body to w. In production this is always
+	// v1.TarGz(w, blk.Reader()); it's a field rather than a direct call so
+	// tests can exercise the surrounding pipe/spill/Seek state machine with
+	// a stub writer, without depending on a real v1.Block.
+	archive func(w io.Writer) error
+	pr      *io.PipeReader
+
+	mu      sync.Mutex
+	hasRead bool
+	spill   *os.File
+}
+
+// newStreamingBlockData starts archiving blk in the background and returns
+// a reader for the resulting tar.gz stream.
+func newStreamingBlockData(blk *v1.Block) *streamingBlockData {
+	return newStreamingBlockDataFromArchiver(func(w io.Writer) error {
+		return v1.TarGz(w, blk.Reader())
+	})
+}
+
+// newStreamingBlockDataFromArchiver is the same as newStreamingBlockData but
+// takes the archiving function directly, letting tests substitute a stub
+// for v1.TarGz.
+func newStreamingBlockDataFromArchiver(archive func(w io.Writer) error) *streamingBlockData {
+	s := &streamingBlockData{archive: archive}
+	s.pr = s.startArchiving()
+	return s
+}
+
+// startArchiving runs s.archive in the background and returns the read end
+// of the pipe it writes to. Called once up front, and again by Seek to
+// restart the archive from scratch after a partial read.
+func (s *streamingBlockData) startArchiving() *io.PipeReader {
+	pr, pw := io.Pipe()
+
+	go func() {
+		bw := pipeBufPool.Get().(*bufio.Writer)
+		bw.Reset(pw)
+		defer func() {
+			bw.Reset(nil)
+			pipeBufPool.Put(bw)
+		}()
+
+		err := s.archive(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func (s *streamingBlockData) SeekNotRequired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.spill == nil && !s.hasRead
+}
+
+func (s *streamingBlockData) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	spill := s.spill
+	s.hasRead = true
+	s.mu.Unlock()
+
+	if spill != nil {
+		return spill.Read(p)
+	}
+	return s.pr.Read(p)
+}
+
+// Seek spills the remainder of the archive to a temp file on first use and
+// seeks within it. If called after data has already been consumed via Read
+// -- e.g. an object client retrying a PUT partway through -- the original
+// pipe can no longer serve the bytes already gone, so the archive is re-run
+// from scratch into the spill file instead of failing the seek.
+func (s *streamingBlockData) Seek(offset int64, whence int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.spill == nil {
+		if s.hasRead {
+			_ = s.pr.Close()
+			s.pr = s.startArchiving()
+			s.hasRead = false
+		}
+		f, err := os.CreateTemp("", "bloom-block-upload-*.tar.gz")
+		if err != nil {
+			return 0, fmt.Errorf("failed to create spill file for block upload: %w", err)
+		}
+		if _, err := io.Copy(f, s.pr); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, fmt.Errorf("failed to spill streaming block data to disk: %w", err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return 0, err
+		}
+		s.spill = f
+	}
+
+	return s.spill.Seek(offset, whence)
+}
+
+func (s *streamingBlockData) Close() error {
+	s.mu.Lock()
+	spill := s.spill
+	s.mu.Unlock()
+
+	_ = s.pr.Close()
+	if spill != nil {
+		name := spill.Name()
+		err := spill.Close()
+		_ = os.Remove(name)
+		return err
+	}
+	return nil
+}
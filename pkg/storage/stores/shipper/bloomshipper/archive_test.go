@@ -0,0 +1,113 @@
+package bloomshipper
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeArchive writes payload to w each time it's invoked, and counts how
+// many times it was called, standing in for v1.TarGz so the pipe/spill/Seek
+// state machine can be tested without a real v1.Block.
+func fakeArchive(payload []byte) (func(w io.Writer) error, *int32) {
+	var calls int32
+	return func(w io.Writer) error {
+		atomic.AddInt32(&calls, 1)
+		_, err := w.Write(payload)
+		return err
+	}, &calls
+}
+
+func TestStreamingBlockData_ReadToEOFWithoutSeek(t *testing.T) {
+	payload := []byte("the quick brown fox jumps over the lazy dog")
+	archive, calls := fakeArchive(payload)
+
+	s := newStreamingBlockDataFromArchiver(archive)
+	defer s.Close()
+
+	got, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, payload, got)
+	require.EqualValues(t, 1, atomic.LoadInt32(calls))
+}
+
+func TestStreamingBlockData_SeekToStartBeforeAnyRead(t *testing.T) {
+	payload := []byte("seek before read spills to a temp file")
+	archive, calls := fakeArchive(payload)
+
+	s := newStreamingBlockDataFromArchiver(archive)
+	defer s.Close()
+
+	require.True(t, s.SeekNotRequired())
+
+	off, err := s.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, off)
+	require.False(t, s.SeekNotRequired())
+
+	got, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, payload, got)
+	// The archive only ran once: Seek(0,0) before any Read spills the
+	// already-running archive to disk rather than restarting it.
+	require.EqualValues(t, 1, atomic.LoadInt32(calls))
+}
+
+func TestStreamingBlockData_SeekAfterPartialReadReRunsArchive(t *testing.T) {
+	payload := []byte("seek after a partial read must re-archive, not error")
+	archive, calls := fakeArchive(payload)
+
+	s := newStreamingBlockDataFromArchiver(archive)
+	defer s.Close()
+
+	buf := make([]byte, 4)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 4, n)
+
+	off, err := s.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, off)
+
+	got, err := io.ReadAll(s)
+	require.NoError(t, err)
+	require.Equal(t, payload, got, "re-archived stream must still read back correctly from the start")
+	require.EqualValues(t, 2, atomic.LoadInt32(calls), "a Seek after a partial Read must re-run the archive")
+}
+
+func TestStreamingBlockData_CloseRemovesSpillFileAndStopsTheGoroutine(t *testing.T) {
+	payload := []byte("close must clean up the spill file")
+	archive, _ := fakeArchive(payload)
+
+	s := newStreamingBlockDataFromArchiver(archive)
+
+	_, err := s.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	require.NotNil(t, s.spill)
+	name := s.spill.Name()
+
+	require.NoError(t, s.Close())
+
+	_, statErr := os.Stat(name)
+	require.True(t, errors.Is(statErr, os.ErrNotExist), "spill file must be removed on Close")
+
+	// The pipe is closed, so the archiving goroutine's writes to it (if any
+	// were still pending) unblock with an error instead of leaking forever.
+	_, err = s.pr.Read(make([]byte, 1))
+	require.Error(t, err)
+}
+
+func TestStreamingBlockData_CloseWithoutSpillDoesNotLeakTheGoroutine(t *testing.T) {
+	payload := []byte("close without ever spilling")
+	archive, _ := fakeArchive(payload)
+
+	s := newStreamingBlockDataFromArchiver(archive)
+	require.NoError(t, s.Close())
+
+	_, err := s.pr.Read(make([]byte, 1))
+	require.Error(t, err)
+}
@@ -0,0 +1,340 @@
+package bloomshipper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/concurrency"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+type cleanerMetrics struct {
+	objectsScanned  *prometheus.CounterVec
+	objectsDeleted  *prometheus.CounterVec
+	objectsRetained *prometheus.CounterVec
+}
+
+func newCleanerMetrics(r prometheus.Registerer) *cleanerMetrics {
+	labels := []string{"type"} // "block" or "meta"
+	return &cleanerMetrics{
+		objectsScanned: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "cleaner_objects_scanned_total",
+			Help:      "Number of objects considered by the bloom Cleaner.",
+		}, labels),
+		objectsDeleted: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "cleaner_objects_deleted_total",
+			Help:      "Number of objects deleted by the bloom Cleaner.",
+		}, labels),
+		objectsRetained: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "cleaner_objects_retained_total",
+			Help:      "Number of objects considered but retained by the bloom Cleaner, e.g. due to the grace period.",
+		}, labels),
+	}
+}
+
+// CleanerConfig configures a Cleaner.
+type CleanerConfig struct {
+	// GracePeriod is the minimum age a candidate block or meta must have
+	// reached before it is eligible for deletion. This guards against
+	// racing a bloom gateway that hasn't refreshed its meta view yet and
+	// may still issue GetBlock for a block this run is about to remove.
+	GracePeriod time.Duration
+	// DryRun, when true, logs what would be deleted without deleting it.
+	DryRun bool
+}
+
+// Cleaner deletes blocks that are no longer referenced as live by any Meta
+// (because some Meta tombstones them, even if another Meta still lists
+// them, or because they were never referenced at all), and Metas that have been wholly
+// superseded by a newer Meta covering the same bounds, once both have aged
+// past the configured grace period.
+type Cleaner struct {
+	cfg     CleanerConfig
+	client  *BloomClient
+	logger  log.Logger
+	metrics *cleanerMetrics
+}
+
+// NewCleaner creates a Cleaner that operates through client.
+func NewCleaner(cfg CleanerConfig, client *BloomClient, logger log.Logger, reg prometheus.Registerer) *Cleaner {
+	return &Cleaner{
+		cfg:     cfg,
+		client:  client,
+		logger:  log.With(logger, "component", "bloom-cleaner"),
+		metrics: newCleanerMetrics(reg),
+	}
+}
+
+// Clean runs one garbage-collection pass for the given tenant/table.
+func (c *Cleaner) Clean(ctx context.Context, tenant, table string) error {
+	listedMetas, err := c.client.listMetaRefs(ctx, tenant, table)
+	if err != nil {
+		return fmt.Errorf("failed to list metas for cleanup: %w", err)
+	}
+
+	metaRefs := make([]MetaRef, 0, len(listedMetas))
+	modifiedAt := make(map[MetaRef]time.Time, len(listedMetas))
+	for _, listed := range listedMetas {
+		metaRefs = append(metaRefs, listed.Ref)
+		modifiedAt[listed.Ref] = listed.ModifiedAt
+	}
+
+	metas, err := c.client.GetMetas(ctx, metaRefs)
+	if err != nil {
+		return fmt.Errorf("failed to fetch metas for cleanup: %w", err)
+	}
+
+	if err := c.cleanBlocks(ctx, tenant, table, metas); err != nil {
+		return err
+	}
+	return c.cleanMetas(ctx, tenant, metas, modifiedAt)
+}
+
+// cleanBlocks deletes any block object in the bucket that is not part of the
+// live set computed by BlocksForMetas across all of the table's metas (i.e.
+// it is tombstoned by at least one meta, or listed by none at all), once it
+// has aged past the grace period.
+func (c *Cleaner) cleanBlocks(ctx context.Context, tenant, table string, metas []Meta) error {
+	allBlocks, err := c.client.listBlockRefs(ctx, tenant, table)
+	if err != nil {
+		return fmt.Errorf("failed to list blocks for cleanup: %w", err)
+	}
+
+	live := make(map[BlockRef]bool, len(allBlocks))
+	for _, ref := range BlocksForMetas(metas, fullInterval, []v1.FingerprintBounds{fullKeyspace}) {
+		live[ref] = true
+	}
+
+	var toDelete []BlockRef
+	for _, listed := range allBlocks {
+		c.metrics.objectsScanned.WithLabelValues("block").Inc()
+
+		if live[listed.Ref] {
+			c.metrics.objectsRetained.WithLabelValues("block").Inc()
+			continue
+		}
+		// Measured from the object's last-modified time in the bucket, not
+		// the log data time range embedded in the ref: a block holding old
+		// log data can be tombstoned moments ago, and it's that tombstoning
+		// a bloom gateway with a stale meta view needs time to catch up on.
+		if ageSince(listed.ModifiedAt) < c.cfg.GracePeriod {
+			c.metrics.objectsRetained.WithLabelValues("block").Inc()
+			continue
+		}
+		toDelete = append(toDelete, listed.Ref)
+	}
+
+	if c.cfg.DryRun {
+		for _, ref := range toDelete {
+			level.Info(c.logger).Log("msg", "dry-run: would delete orphaned/tombstoned block", "tenant", tenant, "ref", ref)
+		}
+		return nil
+	}
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	return concurrency.ForEachJob(ctx, len(toDelete), 16, func(ctx context.Context, idx int) error {
+		if err := c.client.DeleteBlocks(ctx, []BlockRef{toDelete[idx]}); err != nil {
+			return fmt.Errorf("failed to delete block %s: %w", toDelete[idx], err)
+		}
+		c.metrics.objectsDeleted.WithLabelValues("block").Inc()
+		return nil
+	})
+}
+
+// cleanMetas deletes metas whose blocks are all subsumed by a newer meta
+// covering the same bounds, past the grace period. modifiedAt carries each
+// meta's last-modified time in the bucket, as returned by listMetaRefs.
+func (c *Cleaner) cleanMetas(ctx context.Context, tenant string, metas []Meta, modifiedAt map[MetaRef]time.Time) error {
+	var toDelete []MetaRef
+
+	for i, meta := range metas {
+		c.metrics.objectsScanned.WithLabelValues("meta").Inc()
+
+		if ageSince(modifiedAt[meta.MetaRef]) < c.cfg.GracePeriod {
+			c.metrics.objectsRetained.WithLabelValues("meta").Inc()
+			continue
+		}
+
+		if supersededBy(meta, metas[:i], metas[i+1:], modifiedAt) {
+			toDelete = append(toDelete, meta.MetaRef)
+		} else {
+			c.metrics.objectsRetained.WithLabelValues("meta").Inc()
+		}
+	}
+
+	if c.cfg.DryRun {
+		for _, ref := range toDelete {
+			level.Info(c.logger).Log("msg", "dry-run: would delete superseded meta", "tenant", tenant, "ref", ref)
+		}
+		return nil
+	}
+
+	if len(toDelete) == 0 {
+		return nil
+	}
+
+	if err := c.client.DeleteMetas(ctx, toDelete); err != nil {
+		return fmt.Errorf("failed to delete superseded metas: %w", err)
+	}
+	c.metrics.objectsDeleted.WithLabelValues("meta").Add(float64(len(toDelete)))
+	return nil
+}
+
+// supersededBy reports whether every block in meta is also present in some
+// other meta covering the same bounds that outranks it, making meta itself
+// safe to remove. "Outranks" is a total order over metas sharing the same
+// bounds (later modifiedAt wins, ties broken by MetaRef string), not mere
+// coverage: two metas can trivially cover each other when they reference
+// identical blocks (e.g. after a compactor retry re-uploads the same
+// content-addressed blocks under a new meta), and without a tie-break both
+// would see themselves as superseded and both would be deleted in the same
+// pass, losing every block they reference. Ranking ensures at most one of
+// such a pair is ever deleted.
+func supersededBy(meta Meta, before, after []Meta, modifiedAt map[MetaRef]time.Time) bool {
+	var candidates []Meta
+	for _, m := range before {
+		if m.Bounds.Equal(meta.Bounds) && outranks(m, meta, modifiedAt) {
+			candidates = append(candidates, m)
+		}
+	}
+	for _, m := range after {
+		if m.Bounds.Equal(meta.Bounds) && outranks(m, meta, modifiedAt) {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return false
+	}
+
+	covered := make(map[BlockRef]bool, len(meta.Blocks))
+	for _, block := range meta.Blocks {
+		covered[block] = false
+	}
+
+	for _, candidate := range candidates {
+		for _, block := range candidate.Blocks {
+			if _, ok := covered[block]; ok {
+				covered[block] = true
+			}
+		}
+	}
+
+	for _, ok := range covered {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// outranks reports whether a should be preferred over b when both cover the
+// same bounds: later modifiedAt wins, with ties (e.g. a bucket that doesn't
+// report sub-second precision) broken by MetaRef string so the order is
+// total and deterministic regardless of scan order.
+func outranks(a, b Meta, modifiedAt map[MetaRef]time.Time) bool {
+	at, bt := modifiedAt[a.MetaRef], modifiedAt[b.MetaRef]
+	if !at.Equal(bt) {
+		return at.After(bt)
+	}
+	return a.MetaRef.String() > b.MetaRef.String()
+}
+
+// ageSince returns how long ago t was, given an object's last-modified time
+// as reported by the bucket's List response.
+func ageSince(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+// metaPrefixes returns every object-storage prefix under which metas for
+// tenant/table might live. A PeriodicKeyResolver can have registered a
+// distinct layout per schema period, so listing must cover all of them, not
+// just the default layout: hand-building a single default-layout prefix
+// here would silently stop discovering (and thus stop collecting) objects
+// written under any non-default period.
+func (b *BloomClient) metaPrefixes(tenant, table string) []string {
+	if pr, ok := b.KeyResolver.(*PeriodicKeyResolver); ok {
+		return pr.MetaPrefixes(tenant, table)
+	}
+	return []string{b.KeyResolver.MetaPrefix(tenant, table)}
+}
+
+// blockPrefixes is the block equivalent of metaPrefixes.
+func (b *BloomClient) blockPrefixes(tenant, table string) []string {
+	if pr, ok := b.KeyResolver.(*PeriodicKeyResolver); ok {
+		return pr.BlockPrefixes(tenant, table)
+	}
+	return []string{b.KeyResolver.BlockPrefix(tenant, table)}
+}
+
+// listedMeta pairs a MetaRef with the last-modified time object storage
+// reports for it, which the Cleaner uses as the basis for the grace period
+// instead of any timestamp embedded in the ref itself.
+type listedMeta struct {
+	Ref        MetaRef
+	ModifiedAt time.Time
+}
+
+// listedBlock is the block equivalent of listedMeta.
+type listedBlock struct {
+	Ref        BlockRef
+	ModifiedAt time.Time
+}
+
+// listMetaRefs lists the MetaRefs currently present in object storage for
+// tenant/table, without downloading their bodies.
+func (b *BloomClient) listMetaRefs(ctx context.Context, tenant, table string) ([]listedMeta, error) {
+	var listed []listedMeta
+	for _, prefix := range b.metaPrefixes(tenant, table) {
+		objects, _, err := b.client.List(ctx, prefix, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list metas under %s: %w", prefix, err)
+		}
+
+		for _, object := range objects {
+			ref, err := b.ParseMetaKey(object.Key)
+			if err != nil {
+				level.Warn(b.logger).Log("msg", "failed to parse meta key, skipping", "key", object.Key, "err", err)
+				continue
+			}
+			listed = append(listed, listedMeta{Ref: ref, ModifiedAt: object.ModifiedAt})
+		}
+	}
+	return listed, nil
+}
+
+// listBlockRefs lists the BlockRefs currently present in object storage for
+// tenant/table.
+func (b *BloomClient) listBlockRefs(ctx context.Context, tenant, table string) ([]listedBlock, error) {
+	var listed []listedBlock
+	for _, prefix := range b.blockPrefixes(tenant, table) {
+		objects, _, err := b.client.List(ctx, prefix, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list blocks under %s: %w", prefix, err)
+		}
+
+		for _, object := range objects {
+			ref, err := b.ParseBlockKey(object.Key)
+			if err != nil {
+				level.Warn(b.logger).Log("msg", "failed to parse block key, skipping", "key", object.Key, "err", err)
+				continue
+			}
+			listed = append(listed, listedBlock{Ref: ref, ModifiedAt: object.ModifiedAt})
+		}
+	}
+	return listed, nil
+}
@@ -0,0 +1,113 @@
+package bloomshipper
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+func testBlockRef(bounds v1.FingerprintBounds) BlockRef {
+	return BlockRef{Ref: Ref{
+		TenantID:       "t",
+		TableName:      "table",
+		Bounds:         bounds,
+		StartTimestamp: model.Time(0),
+		EndTimestamp:   model.Time(10),
+	}}
+}
+
+func TestBlocksForMetas_FullKeyspaceRetainsEveryLiveBlock(t *testing.T) {
+	b1 := testBlockRef(v1.NewBounds(0, 100))
+	b2 := testBlockRef(v1.NewBounds(101, 200))
+
+	metas := []Meta{{Blocks: []BlockRef{b1, b2}}}
+
+	// This mirrors cleanBlocks' own call: passing fullKeyspace (not nil)
+	// must retain every live block regardless of its fingerprint bounds. A
+	// previous version of this call passed a nil keyspace here, which made
+	// isOutsideRange treat every block as out of range and queued the
+	// entire live set for deletion.
+	live := BlocksForMetas(metas, fullInterval, []v1.FingerprintBounds{fullKeyspace})
+	require.ElementsMatch(t, []BlockRef{b1, b2}, live)
+}
+
+func TestBlocksForMetas_TombstonedBlockIsExcluded(t *testing.T) {
+	b1 := testBlockRef(v1.NewBounds(0, 100))
+
+	metas := []Meta{
+		{Blocks: []BlockRef{b1}},
+		{BlockTombstones: []BlockRef{b1}},
+	}
+
+	live := BlocksForMetas(metas, fullInterval, []v1.FingerprintBounds{fullKeyspace})
+	require.Empty(t, live)
+}
+
+func testMeta(id string, bounds v1.FingerprintBounds, blocks ...BlockRef) Meta {
+	return Meta{MetaRef: MetaRef{Ref: Ref{TenantID: id, Bounds: bounds}}, Blocks: blocks}
+}
+
+func TestSupersededBy(t *testing.T) {
+	bounds := v1.NewBounds(0, 100)
+	b1 := testBlockRef(bounds)
+	b2 := testBlockRef(bounds)
+	b2.Checksum = 1 // distinct from b1, so a candidate holding only b1 misses b2
+	meta := testMeta("meta", bounds, b1, b2)
+	t0 := time.Unix(1000, 0)
+
+	t.Run("covered by a later meta with the same bounds", func(t *testing.T) {
+		newer := testMeta("newer", bounds, b1, b2)
+		modifiedAt := map[MetaRef]time.Time{meta.MetaRef: t0, newer.MetaRef: t0.Add(time.Minute)}
+		require.True(t, supersededBy(meta, nil, []Meta{newer}, modifiedAt))
+	})
+
+	t.Run("not superseded by an earlier meta with the same bounds", func(t *testing.T) {
+		// The earlier commit treated coverage as direction-agnostic, so an
+		// older meta covering meta's blocks was enough to supersede it. That
+		// let two metas with identical blocks and bounds (plausible after a
+		// compactor retry re-uploads the same content-addressed blocks under
+		// a new meta) each see the other as superseded, deleting both in the
+		// same pass and permanently losing every block they reference. Only
+		// a later (higher-ranked) meta may supersede.
+		older := testMeta("older", bounds, b1, b2)
+		modifiedAt := map[MetaRef]time.Time{meta.MetaRef: t0, older.MetaRef: t0.Add(-time.Minute)}
+		require.False(t, supersededBy(meta, []Meta{older}, nil, modifiedAt))
+	})
+
+	t.Run("mutually covering metas with identical blocks: at most one is superseded", func(t *testing.T) {
+		a := testMeta("a", bounds, b1, b2)
+		b := testMeta("b", bounds, b1, b2)
+		modifiedAt := map[MetaRef]time.Time{a.MetaRef: t0, b.MetaRef: t0.Add(time.Minute)}
+
+		aSuperseded := supersededBy(a, nil, []Meta{b}, modifiedAt)
+		bSuperseded := supersededBy(b, []Meta{a}, nil, modifiedAt)
+		require.True(t, aSuperseded, "the earlier meta should be superseded by the later one")
+		require.False(t, bSuperseded, "the later meta must survive, not be superseded by the one it outranks")
+	})
+
+	t.Run("equal modifiedAt ties break deterministically by MetaRef", func(t *testing.T) {
+		a := testMeta("a", bounds, b1, b2)
+		b := testMeta("b", bounds, b1, b2)
+		modifiedAt := map[MetaRef]time.Time{a.MetaRef: t0, b.MetaRef: t0}
+
+		aSuperseded := supersededBy(a, nil, []Meta{b}, modifiedAt)
+		bSuperseded := supersededBy(b, []Meta{a}, nil, modifiedAt)
+		require.NotEqual(t, aSuperseded, bSuperseded, "exactly one of a tied pair must be superseded")
+	})
+
+	t.Run("not covered when a block is missing from every candidate", func(t *testing.T) {
+		newer := testMeta("newer", bounds, b1)
+		modifiedAt := map[MetaRef]time.Time{meta.MetaRef: t0, newer.MetaRef: t0.Add(time.Minute)}
+		require.False(t, supersededBy(meta, nil, []Meta{newer}, modifiedAt))
+	})
+
+	t.Run("no candidates cover the same bounds", func(t *testing.T) {
+		other := testMeta("other", v1.NewBounds(200, 300), b1, b2)
+		modifiedAt := map[MetaRef]time.Time{meta.MetaRef: t0, other.MetaRef: t0.Add(time.Minute)}
+		require.False(t, supersededBy(meta, nil, []Meta{other}, modifiedAt))
+	})
+}
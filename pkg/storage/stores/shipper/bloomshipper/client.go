@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"os"
 
 	"github.com/go-kit/log"
 	"github.com/grafana/dskit/concurrency"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 
 	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
@@ -151,12 +153,6 @@ func MetaRefFrom(
 
 }
 
-type MetaSearchParams struct {
-	TenantID string
-	Interval Interval
-	Keyspace v1.FingerprintBounds
-}
-
 type MetaClient interface {
 	KeyResolver
 	GetMeta(ctx context.Context, ref MetaRef) (Meta, error)
@@ -183,6 +179,9 @@ func (c ClosableReadSeekerAdapter) Close() error {
 	return nil
 }
 
+// BlockFrom archives and compresses blk and returns a Block ready to be
+// uploaded via PutBlock. The archive is streamed through an io.Pipe rather
+// than buffered in memory in full; see streamingBlockData for details.
 func BlockFrom(tenant, table string, blk *v1.Block) (Block, error) {
 	md, _ := blk.Metadata()
 	ref := Ref{
@@ -194,19 +193,9 @@ func BlockFrom(tenant, table string, blk *v1.Block) (Block, error) {
 		Checksum:       md.Checksum,
 	}
 
-	// TODO(owen-d): pool
-	buf := bytes.NewBuffer(nil)
-	err := v1.TarGz(buf, blk.Reader())
-
-	if err != nil {
-		return Block{}, errors.Wrap(err, "archiving+compressing block")
-	}
-
-	reader := bytes.NewReader(buf.Bytes())
-
 	return Block{
 		BlockRef: BlockRef{Ref: ref},
-		Data:     ClosableReadSeekerAdapter{reader},
+		Data:     newStreamingBlockData(blk),
 	}, nil
 }
 
@@ -216,6 +205,9 @@ type BlockClient interface {
 	GetBlocks(ctx context.Context, refs []BlockRef) ([]BlockDirectory, error)
 	PutBlock(ctx context.Context, block Block) error
 	DeleteBlocks(ctx context.Context, refs []BlockRef) error
+	// VerifyBlock checks dir against the client's configured
+	// BlockVerification mode, returning an *ErrCorruptBlock on failure.
+	VerifyBlock(ctx context.Context, dir BlockDirectory) error
 }
 
 type Client interface {
@@ -228,22 +220,56 @@ type Client interface {
 // Compiler check to ensure BloomClient implements the Client interface
 var _ Client = &BloomClient{}
 
+// defaultDownloadQueueConcurrency is used when bloomStoreConfig doesn't
+// specify DownloadQueueConcurrency, preserving prior behavior for callers
+// that haven't set it explicitly.
+const defaultDownloadQueueConcurrency = 16
+
 type BloomClient struct {
 	KeyResolver
-	concurrency int
-	client      client.ObjectClient
-	logger      log.Logger
-	fsResolver  KeyResolver
-}
-
-func NewBloomClient(cfg bloomStoreConfig, client client.ObjectClient, logger log.Logger) (*BloomClient, error) {
-	return &BloomClient{
-		KeyResolver: defaultKeyResolver{}, // TODO(owen-d): hook into schema, similar to `{,Parse}ExternalKey`
-		fsResolver:  NewPrefixedResolver(cfg.workingDir, defaultKeyResolver{}),
-		concurrency: cfg.numWorkers,
-		client:      client,
-		logger:      logger,
-	}, nil
+	concurrency   int
+	client        client.ObjectClient
+	logger        log.Logger
+	fsResolver    KeyResolver
+	downloads     *downloadQueue
+	verification  BlockVerification
+	verifyMetrics *verifyMetrics
+	// openBlock opens dir's underlying v1.Block for verification. It's a
+	// field rather than a direct v1BlockAdapter{dir.Block(b.logger)} call so
+	// tests can substitute a fake verifiableBlock and exercise VerifyBlock's
+	// modes without a real, on-disk bloom block.
+	openBlock func(dir BlockDirectory) verifiableBlock
+}
+
+func NewBloomClient(cfg bloomStoreConfig, periods []config.PeriodConfig, client client.ObjectClient, logger log.Logger) (*BloomClient, error) {
+	resolver, err := NewPeriodicKeyResolver(periods)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating periodic key resolver")
+	}
+
+	verification := cfg.verification
+	if verification == "" {
+		verification = BlockVerificationChecksum
+	}
+
+	b := &BloomClient{
+		KeyResolver:  resolver,
+		fsResolver:   NewPrefixedResolver(cfg.workingDir, defaultKeyResolver{}),
+		concurrency:  cfg.numWorkers,
+		client:       client,
+		logger:       logger,
+		verification: verification,
+	}
+	downloadQueueConcurrency := cfg.downloadQueueConcurrency
+	if downloadQueueConcurrency <= 0 {
+		downloadQueueConcurrency = defaultDownloadQueueConcurrency
+	}
+	b.downloads = newDownloadQueue(downloadQueueConcurrency, b.downloadBlock, logger, prometheus.DefaultRegisterer)
+	b.verifyMetrics = newVerifyMetrics(prometheus.DefaultRegisterer)
+	b.openBlock = func(dir BlockDirectory) verifiableBlock {
+		return v1BlockAdapter{blk: dir.Block(b.logger)}
+	}
+	return b, nil
 }
 
 func (b *BloomClient) IsObjectNotFoundErr(err error) bool {
@@ -268,8 +294,25 @@ func (b *BloomClient) DeleteMetas(ctx context.Context, refs []MetaRef) error {
 	return err
 }
 
-// GetBlock downloads the blocks from objectStorage and returns the downloaded block
+// GetBlock downloads the block from object storage and returns the
+// downloaded block. Concurrent requests for the same BlockRef are
+// coalesced by the client's download queue.
 func (b *BloomClient) GetBlock(ctx context.Context, ref BlockRef) (BlockDirectory, error) {
+	addr := b.Block(ref).Addr()
+	dir, release, err := b.downloads.Do(ctx, addr, ref)
+	if err != nil {
+		return BlockDirectory{}, err
+	}
+	// The refcounted cleanup tracked by the download queue is only about
+	// coalescing concurrent fetches of the same block; callers manage the
+	// lifecycle of the returned BlockDirectory as before.
+	release()
+	return dir, nil
+}
+
+// downloadBlock performs the actual download+extraction of a single block.
+// It is the function driven by the client's download queue.
+func (b *BloomClient) downloadBlock(ctx context.Context, ref BlockRef) (BlockDirectory, error) {
 	key := b.Block(ref).Addr()
 	readCloser, _, err := b.client.GetObject(ctx, key)
 	if err != nil {
@@ -282,14 +325,15 @@ func (b *BloomClient) GetBlock(ctx context.Context, ref BlockRef) (BlockDirector
 		return BlockDirectory{}, fmt.Errorf("failed to extract block into directory : %w", err)
 	}
 
-	return NewBlockDirectory(ref, path, b.logger), nil
+	dir := NewBlockDirectory(ref, path, b.logger)
+	if err := b.VerifyBlock(ctx, dir); err != nil {
+		return BlockDirectory{}, err
+	}
+
+	return dir, nil
 }
 
 func (b *BloomClient) GetBlocks(ctx context.Context, refs []BlockRef) ([]BlockDirectory, error) {
-	// TODO(chaudum): Integrate download queue
-	// The current implementation does brute-force download of all blocks with maximum concurrency.
-	// However, we want that a single block is downloaded only exactly once, even if it is requested
-	// multiple times concurrently.
 	results := make([]BlockDirectory, len(refs))
 	err := concurrency.ForEachJob(ctx, len(refs), b.concurrency, func(ctx context.Context, idx int) error {
 		block, err := b.GetBlock(ctx, refs[idx])
@@ -308,19 +352,65 @@ func (b *BloomClient) PutBlock(ctx context.Context, block Block) error {
 		_ = Data.Close()
 	}(block.Data)
 
+	if b.verification != BlockVerificationOff {
+		// A block built without a populated checksum can never have been
+		// produced by BlockFrom; refuse to upload it rather than serving it
+		// back later as if it were trustworthy.
+		if block.Checksum == 0 {
+			return &ErrCorruptBlock{Ref: block.BlockRef, Reason: "missing checksum prior to upload"}
+		}
+		if err := b.verifyBeforeUpload(ctx, block); err != nil {
+			return err
+		}
+	}
+
 	key := b.Block(block.BlockRef).Addr()
-	_, err := block.Data.Seek(0, 0)
-	if err != nil {
-		return fmt.Errorf("error uploading block file %s : %w", key, err)
+
+	// Skip the defensive rewind (and the temp-file spill it can trigger on
+	// a streaming reader) when the reader tells us it's already positioned
+	// at the start and doesn't need it.
+	if sl, ok := block.Data.(seekless); !ok || !sl.SeekNotRequired() {
+		if _, err := block.Data.Seek(0, 0); err != nil {
+			return fmt.Errorf("error uploading block file %s : %w", key, err)
+		}
 	}
 
-	err = b.client.PutObject(ctx, key, block.Data)
+	err := b.client.PutObject(ctx, key, block.Data)
 	if err != nil {
 		return fmt.Errorf("error uploading block file: %w", err)
 	}
 	return nil
 }
 
+// verifyBeforeUpload extracts the archived block into a scratch directory
+// and runs it through the same VerifyBlock a download applies, catching a
+// body that doesn't actually match block.Checksum (e.g. bit-rot in transit
+// from the compactor) before it ever reaches object storage, rather than
+// just checking that a checksum was present at all. block.Data is rewound
+// to the start both before and after, so the caller's subsequent upload
+// reads the whole stream from the beginning.
+func (b *BloomClient) verifyBeforeUpload(ctx context.Context, block Block) error {
+	if _, err := block.Data.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to rewind block for pre-upload verification: %w", err)
+	}
+
+	path := b.fsResolver.Block(block.BlockRef).LocalPath() + "-verify"
+	if err := extractBlock(io.NopCloser(block.Data), path, b.logger); err != nil {
+		return fmt.Errorf("failed to extract block for pre-upload verification: %w", err)
+	}
+	defer os.RemoveAll(path)
+
+	dir := NewBlockDirectory(block.BlockRef, path, b.logger)
+	if err := b.VerifyBlock(ctx, dir); err != nil {
+		return err
+	}
+
+	if _, err := block.Data.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to rewind block after pre-upload verification: %w", err)
+	}
+	return nil
+}
+
 func (b *BloomClient) DeleteBlocks(ctx context.Context, references []BlockRef) error {
 	return concurrency.ForEachJob(ctx, len(references), b.concurrency, func(ctx context.Context, idx int) error {
 		ref := references[idx]
@@ -369,12 +459,16 @@ func (b *BloomClient) GetMeta(ctx context.Context, ref MetaRef) (Meta, error) {
 	return meta, nil
 }
 
-func findPeriod(configs []config.PeriodConfig, ts model.Time) (config.DayTime, error) {
+// FindPeriod returns the PeriodConfig that is active for ts: the most
+// recent period whose From is not after ts. Schema changes take effect at
+// their From boundary, so this mirrors how Loki's chunk store picks the
+// period for a given chunk.
+func FindPeriod(configs []config.PeriodConfig, ts model.Time) (config.PeriodConfig, error) {
 	for i := len(configs) - 1; i >= 0; i-- {
 		periodConfig := configs[i]
 		if !periodConfig.From.Time.After(ts) {
-			return periodConfig.From, nil
+			return periodConfig, nil
 		}
 	}
-	return config.DayTime{}, fmt.Errorf("can not find period for timestamp %d", ts)
+	return config.PeriodConfig{}, fmt.Errorf("can not find period for timestamp %d", ts)
 }
@@ -0,0 +1,60 @@
+package bloomshipper
+
+import "flag"
+
+// Config configures the bloom shipper's object storage client. It is
+// converted to the internal bloomStoreConfig consumed by NewBloomClient via
+// toStoreConfig.
+type Config struct {
+	WorkingDirectory string `yaml:"working_directory"`
+	NumWorkers       int    `yaml:"num_workers"`
+
+	// DownloadQueueConcurrency bounds how many block downloads the
+	// downloadQueue runs at once. It is independent of NumWorkers, which
+	// bounds concurrency of the independent (non-overlapping) requests
+	// issued by GetBlocks; see downloadQueue.
+	DownloadQueueConcurrency int `yaml:"download_queue_concurrency"`
+
+	// BlockVerification controls how thoroughly GetBlock/PutBlock check a
+	// block before trusting it. One of: off, checksum, full. See
+	// BlockVerification.
+	BlockVerification string `yaml:"block_verification"`
+}
+
+// RegisterFlags registers flags for Config with the "bloom-shipper." prefix.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.RegisterFlagsWithPrefix("bloom-shipper.", f)
+}
+
+// RegisterFlagsWithPrefix registers flags for Config with the given prefix.
+func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.StringVar(&cfg.WorkingDirectory, prefix+"working-directory", "", "Directory used to store bloom blocks downloaded from, and staged for upload to, object storage.")
+	f.IntVar(&cfg.NumWorkers, prefix+"num-workers", 16, "Number of workers used for parallel block/meta requests to object storage.")
+	f.IntVar(&cfg.DownloadQueueConcurrency, prefix+"download-queue-concurrency", defaultDownloadQueueConcurrency, "Maximum number of concurrent block downloads performed by the download queue, independent of num-workers.")
+	f.StringVar(&cfg.BlockVerification, prefix+"block-verification", string(BlockVerificationChecksum), "Controls how thoroughly a downloaded or about-to-be-uploaded block is verified. One of: off, checksum, full.")
+}
+
+// toStoreConfig converts the operator-facing Config into the internal
+// bloomStoreConfig consumed by NewBloomClient.
+func (cfg Config) toStoreConfig() bloomStoreConfig {
+	return bloomStoreConfig{
+		workingDir:               cfg.WorkingDirectory,
+		numWorkers:               cfg.NumWorkers,
+		downloadQueueConcurrency: cfg.DownloadQueueConcurrency,
+		verification:             BlockVerification(cfg.BlockVerification),
+	}
+}
+
+// bloomStoreConfig is the internal configuration consumed by NewBloomClient,
+// assembled from the operator-facing Config via toStoreConfig.
+type bloomStoreConfig struct {
+	workingDir string
+	numWorkers int
+
+	// downloadQueueConcurrency seeds the downloadQueue's worker concurrency;
+	// see Config.DownloadQueueConcurrency.
+	downloadQueueConcurrency int
+
+	// verification seeds BloomClient.verification; see Config.BlockVerification.
+	verification BlockVerification
+}
@@ -0,0 +1,189 @@
+package bloomshipper
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type downloadQueueMetrics struct {
+	queueDepth      prometheus.Gauge
+	dedupedHit      prometheus.Counter
+	dedupedAll      prometheus.Counter
+	downloadLatency prometheus.Histogram
+}
+
+func newDownloadQueueMetrics(r prometheus.Registerer) *downloadQueueMetrics {
+	return &downloadQueueMetrics{
+		queueDepth: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "download_queue_depth",
+			Help:      "Number of distinct block downloads currently in flight.",
+		}),
+		dedupedHit: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "download_queue_deduped_total",
+			Help:      "Number of GetBlock requests that attached to an already in-flight download instead of issuing a new one.",
+		}),
+		dedupedAll: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "download_queue_requests_total",
+			Help:      "Total number of GetBlock requests made through the download queue.",
+		}),
+		downloadLatency: promauto.With(r).NewHistogram(prometheus.HistogramOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "download_latency_seconds",
+			Help:      "Latency of individual (non-deduped) block downloads.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+}
+
+// downloadFunc performs the actual download of a single block.
+type downloadFunc func(ctx context.Context, ref BlockRef) (BlockDirectory, error)
+
+// downloadJob tracks a single in-flight download for a given block address.
+// Multiple callers requesting the same address attach to the same job and
+// all receive the same result. The refcount only decides when the job is
+// removed from the dedup map; the BlockDirectory itself is not deleted or
+// otherwise cleaned up when the last waiter releases it.
+type downloadJob struct {
+	refs int
+
+	done   chan struct{}
+	result BlockDirectory
+	err    error
+}
+
+// downloadQueue coalesces concurrent requests for the same BlockRef into a
+// single download, run on a bounded worker pool. The shared download always
+// runs to completion once started, regardless of how many waiters cancel
+// their own context in the meantime: it runs under context.Background() so
+// that a caller giving up doesn't throw away a download other, still-waiting
+// callers (or the next caller to arrive before this one finishes) depend on.
+type downloadQueue struct {
+	download downloadFunc
+	logger   log.Logger
+	metrics  *downloadQueueMetrics
+
+	sem chan struct{}
+
+	mu   sync.Mutex
+	jobs map[string]*downloadJob
+}
+
+// newDownloadQueue creates a downloadQueue backed by fn, with concurrency
+// concurrent downloads permitted at once. concurrency is configured
+// separately from cfg.numWorkers, which governs concurrency of independent
+// (non-overlapping) requests.
+func newDownloadQueue(concurrency int, fn downloadFunc, logger log.Logger, reg prometheus.Registerer) *downloadQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &downloadQueue{
+		download: fn,
+		logger:   logger,
+		metrics:  newDownloadQueueMetrics(reg),
+		sem:      make(chan struct{}, concurrency),
+		jobs:     make(map[string]*downloadJob),
+	}
+}
+
+// Do returns the BlockDirectory for ref, downloading it if no download for
+// addr is currently in flight, or attaching to the existing one otherwise.
+// release must be called once the caller is done with the returned
+// BlockDirectory.
+func (q *downloadQueue) Do(ctx context.Context, addr string, ref BlockRef) (dir BlockDirectory, release func(), err error) {
+	q.metrics.dedupedAll.Inc()
+
+	q.mu.Lock()
+	job, ok := q.jobs[addr]
+	if ok {
+		job.refs++
+		q.mu.Unlock()
+		q.metrics.dedupedHit.Inc()
+	} else {
+		job = &downloadJob{refs: 1, done: make(chan struct{})}
+		q.jobs[addr] = job
+		q.mu.Unlock()
+		q.metrics.queueDepth.Inc()
+
+		go q.run(addr, ref, job)
+	}
+
+	release = func() {
+		q.mu.Lock()
+		job.refs--
+		refsZero := job.refs <= 0
+		q.mu.Unlock()
+
+		if !refsZero {
+			return
+		}
+
+		// Only remove the job from the dedup map once its download has
+		// actually finished. If it's still running (e.g. this was the last
+		// waiter and it gave up via ctx.Done before the shared download
+		// completed), leave it in place: run will remove it once done, so
+		// a new caller for the same addr attaches to the still-in-flight
+		// download instead of starting a fully duplicate one.
+		select {
+		case <-job.done:
+			q.mu.Lock()
+			if cur, ok := q.jobs[addr]; ok && cur == job {
+				delete(q.jobs, addr)
+			}
+			q.mu.Unlock()
+		default:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		release()
+		return BlockDirectory{}, func() {}, ctx.Err()
+	case <-job.done:
+		if job.err != nil {
+			release()
+			return BlockDirectory{}, func() {}, job.err
+		}
+		return job.result, release, nil
+	}
+}
+
+func (q *downloadQueue) run(addr string, ref BlockRef, job *downloadJob) {
+	q.sem <- struct{}{}
+
+	// The shared download is intentionally run with a background context:
+	// a single waiter cancelling its own request must not cancel the
+	// download for the others still waiting on it.
+	timer := prometheus.NewTimer(q.metrics.downloadLatency)
+	job.result, job.err = q.download(context.Background(), ref)
+	timer.ObserveDuration()
+	if job.err != nil {
+		job.err = fmt.Errorf("failed to download block %s: %w", addr, job.err)
+	}
+
+	<-q.sem
+	close(job.done)
+
+	// Every waiter may have already given up (refs <= 0) while this was
+	// still running; release() leaves removal to us in that case so a new
+	// caller can't start a duplicate download against an in-flight job.
+	q.mu.Lock()
+	if job.refs <= 0 {
+		if cur, ok := q.jobs[addr]; ok && cur == job {
+			delete(q.jobs, addr)
+		}
+	}
+	q.mu.Unlock()
+	q.metrics.queueDepth.Dec()
+}
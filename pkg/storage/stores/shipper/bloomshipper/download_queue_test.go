@@ -0,0 +1,112 @@
+package bloomshipper
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadQueue_DedupsConcurrentRequests(t *testing.T) {
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	q := newDownloadQueue(4, func(ctx context.Context, ref BlockRef) (BlockDirectory, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return BlockDirectory{}, nil
+	}, log.NewNopLogger(), prometheus.NewRegistry())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, rel, err := q.Do(context.Background(), "addr", BlockRef{})
+			require.NoError(t, err)
+			rel()
+		}()
+	}
+
+	<-started
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls), "expected concurrent requests for the same addr to share a single download")
+}
+
+func TestDownloadQueue_WaiterCancelDoesNotAbortSharedDownload(t *testing.T) {
+	release := make(chan struct{})
+	done := make(chan BlockDirectory, 1)
+
+	q := newDownloadQueue(1, func(ctx context.Context, ref BlockRef) (BlockDirectory, error) {
+		<-release
+		// The shared download must keep running on context.Background even
+		// though the sole waiter below has already cancelled.
+		require.NoError(t, ctx.Err())
+		dir := BlockDirectory{}
+		done <- dir
+		return dir, nil
+	}, log.NewNopLogger(), prometheus.NewRegistry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _, err := q.Do(ctx, "addr", BlockRef{})
+		require.ErrorIs(t, err, context.Canceled)
+	}()
+
+	// Give the download goroutine a moment to register the job, then cancel
+	// the only waiter before the download completes.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shared download did not run to completion after its only waiter cancelled")
+	}
+}
+
+func TestDownloadQueue_CancelledWaiterDoesNotOrphanDedup(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+
+	q := newDownloadQueue(1, func(ctx context.Context, ref BlockRef) (BlockDirectory, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return BlockDirectory{}, nil
+	}, log.NewNopLogger(), prometheus.NewRegistry())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _, _ = q.Do(ctx, "addr", BlockRef{})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	// A second caller arrives for the same addr while the first download is
+	// still in flight and its only waiter has already given up. It must
+	// attach to the still-running job rather than starting a duplicate one.
+	go func() {
+		_, rel, err := q.Do(context.Background(), "addr", BlockRef{})
+		require.NoError(t, err)
+		rel()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls), "a waiter cancelling its own context must not cause a duplicate download to be started for the same addr")
+}
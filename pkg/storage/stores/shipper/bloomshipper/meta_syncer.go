@@ -0,0 +1,375 @@
+package bloomshipper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+// fullInterval spans the entire representable time range. It is used
+// wherever a time-filtered helper (e.g. BlocksForMetas) must not filter out
+// any block by time; the MetaSyncer narrows its metas by time only through
+// its MetaFilters.
+var fullInterval = NewInterval(model.Time(0), model.Time(math.MaxInt64))
+
+// fullKeyspace spans the entire fingerprint space. It is used wherever a
+// keyspace-filtered helper (e.g. BlocksForMetas) must not filter out any
+// block by fingerprint range.
+var fullKeyspace = v1.NewBounds(0, model.Fingerprint(math.MaxUint64))
+
+// MetaFilter is applied to the set of Metas returned by a sync before they
+// are handed back to the caller of Fetch. Filters are combined with AND
+// semantics: a Meta survives only if every filter keeps it.
+type MetaFilter func(Meta) bool
+
+// FilterByTime drops any Meta whose interval does not overlap interval.
+func FilterByTime(interval Interval) MetaFilter {
+	return func(meta Meta) bool {
+		return interval.Overlaps(meta.Interval())
+	}
+}
+
+// FilterByTenant drops any Meta that does not belong to tenant.
+func FilterByTenant(tenant string) MetaFilter {
+	return func(meta Meta) bool {
+		return meta.TenantID == tenant
+	}
+}
+
+// MetaFetcher is the interface a MetaSyncer uses to retrieve the current
+// set of Metas for a tenant/table from object storage; BloomClient
+// implements it. Listing and
+// fetching are kept as separate methods, rather than a single call that
+// returns full Meta bodies, so that a sync can consult its on-disk parse
+// cache (keyed by MetaRef.Checksum, which a listing already carries) before
+// paying for a GetMeta on refs it has already parsed.
+type MetaFetcher interface {
+	// ListMetas returns the current MetaRefs for tenant/table, without
+	// downloading their bodies.
+	ListMetas(ctx context.Context, tenant, table string) ([]MetaRef, error)
+	// GetMeta downloads and parses a single Meta body.
+	GetMeta(ctx context.Context, ref MetaRef) (Meta, error)
+}
+
+// ListMetas implements MetaFetcher, letting a MetaSyncer sync directly
+// against a BloomClient.
+func (b *BloomClient) ListMetas(ctx context.Context, tenant, table string) ([]MetaRef, error) {
+	listed, err := b.listMetaRefs(ctx, tenant, table)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]MetaRef, len(listed))
+	for i, l := range listed {
+		refs[i] = l.Ref
+	}
+	return refs, nil
+}
+
+// Compiler check to ensure BloomClient implements MetaFetcher.
+var _ MetaFetcher = &BloomClient{}
+
+// MetaSyncerConfig configures a MetaSyncer.
+type MetaSyncerConfig struct {
+	// SyncInterval controls how often the background loop refreshes the
+	// in-memory index from object storage.
+	SyncInterval time.Duration
+	// CacheDir is where parsed meta.json bodies are persisted across
+	// restarts, keyed by MetaRef.Checksum.
+	CacheDir string
+}
+
+type metaSyncerMetrics struct {
+	metasSynced  prometheus.Gauge
+	syncFailures prometheus.Counter
+	syncDuration prometheus.Histogram
+	loaded       prometheus.Counter
+	modified     prometheus.Counter
+}
+
+func newMetaSyncerMetrics(r prometheus.Registerer) *metaSyncerMetrics {
+	return &metaSyncerMetrics{
+		metasSynced: promauto.With(r).NewGauge(prometheus.GaugeOpts{
+			Namespace: "loki",
+			Subsystem: "bloom",
+			Name:      "metas_synced",
+			Help:      "Number of metas currently held in the MetaSyncer's in-memory index.",
+		}),
+		syncFailures: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom",
+			Name:      "sync_failures_total",
+			Help:      "Number of failed meta sync attempts.",
+		}),
+		syncDuration: promauto.With(r).NewHistogram(prometheus.HistogramOpts{
+			Namespace: "loki",
+			Subsystem: "bloom",
+			Name:      "sync_duration_seconds",
+			Help:      "Time spent syncing metas from object storage.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		loaded: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom",
+			Name:      "loaded",
+			Help:      "Number of metas loaded from the on-disk parse cache without hitting object storage.",
+		}),
+		modified: promauto.With(r).NewCounter(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom",
+			Name:      "modified",
+			Help:      "Number of times the set of active MetaRefs changed between syncs.",
+		}),
+	}
+}
+
+// MetaSyncer periodically lists and fetches Meta files from object storage
+// into an in-memory index scoped to a single tenant/table/keyspace, so that
+// a caller holding many such indexes (e.g. one per query shard) can refresh
+// and query them independently without each issuing its own GetMetas
+// round-trip. No such caller exists in this tree yet -- the bloom gateway
+// and compactor referenced in earlier design discussion aren't part of this
+// snapshot -- so MetaSyncer is exercised only by its own tests for now; wire
+// it up wherever a sharded meta view is actually needed.
+//
+// A Meta identified by its checksum is immutable once written, so parsed
+// bodies can be cached indefinitely on disk; only the set of active
+// MetaRefs returned by a sync changes over time.
+type MetaSyncer struct {
+	cfg      MetaSyncerConfig
+	fetcher  MetaFetcher
+	tenant   string
+	table    string
+	keyspace v1.FingerprintBounds
+	filters  []MetaFilter
+	logger   log.Logger
+	metrics  *metaSyncerMetrics
+
+	mu    sync.RWMutex
+	metas map[MetaRef]Meta
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewMetaSyncer creates a MetaSyncer for a single tenant/table pair. filters
+// are applied, in order, to every Meta returned by Fetch.
+func NewMetaSyncer(
+	cfg MetaSyncerConfig,
+	fetcher MetaFetcher,
+	tenant, table string,
+	keyspace v1.FingerprintBounds,
+	filters []MetaFilter,
+	logger log.Logger,
+	reg prometheus.Registerer,
+) (*MetaSyncer, error) {
+	if cfg.CacheDir != "" {
+		if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create meta cache dir: %w", err)
+		}
+	}
+
+	return &MetaSyncer{
+		cfg:      cfg,
+		fetcher:  fetcher,
+		tenant:   tenant,
+		table:    table,
+		keyspace: keyspace,
+		filters:  filters,
+		logger:   log.With(logger, "component", "bloom-meta-syncer", "tenant", tenant, "table", table),
+		metrics:  newMetaSyncerMetrics(reg),
+		metas:    make(map[MetaRef]Meta),
+	}, nil
+}
+
+// Fetch returns the current set of Metas known to the syncer, filtered
+// according to the configured MetaFilters. It does not itself perform a
+// sync; callers that want a fresh view should use Start/Stop to run the
+// background loop, or call Sync directly.
+func (s *MetaSyncer) Fetch(_ context.Context) ([]Meta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	metas := make([]Meta, 0, len(s.metas))
+outer:
+	for _, meta := range s.metas {
+		for _, filter := range s.filters {
+			if !filter(meta) {
+				continue outer
+			}
+		}
+		metas = append(metas, meta)
+	}
+
+	return metas, nil
+}
+
+// LiveBlocks returns the set of block refs that are still live across the
+// syncer's current Metas -- i.e. listed by some Meta and tombstoned by
+// none -- restricted to the syncer's keyspace. It's the
+// block-level counterpart to Fetch: Fetch dedupes and filters Metas,
+// LiveBlocks (via BlocksForMetas) dedupes and filters the Blocks they in
+// turn reference.
+func (s *MetaSyncer) LiveBlocks(ctx context.Context) ([]BlockRef, error) {
+	metas, err := s.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return BlocksForMetas(metas, fullInterval, []v1.FingerprintBounds{s.keyspace}), nil
+}
+
+// Start launches the background sync loop on the configured interval. It
+// returns immediately; call Stop to terminate the loop.
+func (s *MetaSyncer) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.cfg.SyncInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.Sync(ctx); err != nil {
+				level.Error(s.logger).Log("msg", "failed to sync bloom metas", "err", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop terminates the background sync loop and waits for it to exit.
+func (s *MetaSyncer) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.done != nil {
+		<-s.done
+	}
+}
+
+// Sync lists the current set of MetaRefs from object storage, resolving
+// each to a Meta body from the on-disk parse cache where possible (falling
+// back to GetMeta only for refs not already cached by checksum), and
+// atomically swaps the result into the in-memory index.
+func (s *MetaSyncer) Sync(ctx context.Context) error {
+	start := time.Now()
+	err := s.sync(ctx)
+	s.metrics.syncDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.syncFailures.Inc()
+	}
+	return err
+}
+
+func (s *MetaSyncer) sync(ctx context.Context) error {
+	refs, err := s.fetcher.ListMetas(ctx, s.tenant, s.table)
+	if err != nil {
+		return fmt.Errorf("failed to list metas: %w", err)
+	}
+
+	next := make(map[MetaRef]Meta, len(refs))
+	for _, ref := range refs {
+		// A listing already carries the Meta's fingerprint bounds, so a ref
+		// outside the syncer's keyspace can be dropped before it costs a
+		// cache lookup or a GetMeta round-trip.
+		if !s.keyspace.Overlaps(ref.Bounds) {
+			continue
+		}
+
+		// The cache is keyed by checksum, and a Meta identified by its
+		// checksum is immutable, so a cache hit here means the body is
+		// already known and GetMeta can be skipped entirely.
+		if s.cfg.CacheDir != "" {
+			if cached, ok := s.loadFromCache(ref); ok {
+				s.metrics.loaded.Inc()
+				next[ref] = cached
+				continue
+			}
+		}
+
+		meta, err := s.fetcher.GetMeta(ctx, ref)
+		if err != nil {
+			level.Warn(s.logger).Log("msg", "failed to fetch meta, skipping", "ref", ref, "err", err)
+			continue
+		}
+
+		if s.cfg.CacheDir != "" {
+			if err := s.writeToCache(ref, meta); err != nil {
+				level.Warn(s.logger).Log("msg", "failed to persist meta to cache", "ref", ref, "err", err)
+			}
+		}
+		next[ref] = meta
+	}
+
+	s.mu.Lock()
+	changed := len(next) != len(s.metas)
+	if !changed {
+		for ref := range next {
+			if _, ok := s.metas[ref]; !ok {
+				changed = true
+				break
+			}
+		}
+	}
+	s.metas = next
+	s.mu.Unlock()
+
+	if changed {
+		s.metrics.modified.Inc()
+	}
+	s.metrics.metasSynced.Set(float64(len(next)))
+
+	return nil
+}
+
+func (s *MetaSyncer) cachePath(ref MetaRef) string {
+	return filepath.Join(s.cfg.CacheDir, fmt.Sprintf("%x.json", ref.Checksum))
+}
+
+func (s *MetaSyncer) loadFromCache(ref MetaRef) (Meta, bool) {
+	path := s.cachePath(ref)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Meta{}, false
+	}
+
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		// A malformed cache entry is not trustworthy: drop it and fall back
+		// to the freshly fetched body rather than failing the sync.
+		level.Warn(s.logger).Log("msg", "malformed meta cache entry, discarding", "path", path, "err", err)
+		_ = os.Remove(path)
+		return Meta{}, false
+	}
+	meta.MetaRef = ref
+
+	return meta, true
+}
+
+func (s *MetaSyncer) writeToCache(ref MetaRef, meta Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.cachePath(ref), data, 0o644)
+}
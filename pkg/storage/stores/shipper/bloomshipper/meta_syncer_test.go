@@ -0,0 +1,120 @@
+package bloomshipper
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+type fakeMetaFetcher struct {
+	refs     []MetaRef
+	metas    map[MetaRef]Meta
+	getCalls int32
+}
+
+func (f *fakeMetaFetcher) ListMetas(_ context.Context, _, _ string) ([]MetaRef, error) {
+	return f.refs, nil
+}
+
+func (f *fakeMetaFetcher) GetMeta(_ context.Context, ref MetaRef) (Meta, error) {
+	atomic.AddInt32(&f.getCalls, 1)
+	meta, ok := f.metas[ref]
+	if !ok {
+		return Meta{}, fmt.Errorf("no such meta: %s", ref)
+	}
+	return meta, nil
+}
+
+func TestMetaSyncer_Sync_SkipsGetMetaForCachedChecksums(t *testing.T) {
+	dir := t.TempDir()
+	ref := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", Checksum: 42}}
+	fetcher := &fakeMetaFetcher{
+		refs:  []MetaRef{ref},
+		metas: map[MetaRef]Meta{ref: {MetaRef: ref}},
+	}
+	cfg := MetaSyncerConfig{CacheDir: dir}
+
+	syncer, err := NewMetaSyncer(cfg, fetcher, "t", "table", fullKeyspace, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(context.Background()))
+	require.EqualValues(t, 1, atomic.LoadInt32(&fetcher.getCalls))
+
+	// A second syncer simulates a restart against the same cache dir: it
+	// must serve the already-cached body and never call GetMeta again for
+	// the same checksum.
+	restarted, err := NewMetaSyncer(cfg, fetcher, "t", "table", fullKeyspace, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, restarted.Sync(context.Background()))
+	require.EqualValues(t, 1, atomic.LoadInt32(&fetcher.getCalls), "restart should load the cached meta instead of re-downloading it")
+
+	metas, err := restarted.Fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+}
+
+func TestMetaSyncer_Sync_SkipsRefWhoseGetMetaFails(t *testing.T) {
+	good := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", Checksum: 1}}
+	bad := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", Checksum: 2}}
+	fetcher := &fakeMetaFetcher{
+		refs:  []MetaRef{good, bad},
+		metas: map[MetaRef]Meta{good: {MetaRef: good}},
+	}
+
+	syncer, err := NewMetaSyncer(MetaSyncerConfig{}, fetcher, "t", "table", fullKeyspace, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(context.Background()))
+
+	metas, err := syncer.Fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metas, 1, "a ref whose body can't be fetched should be skipped, not fail the whole sync")
+}
+
+func TestMetaSyncer_Sync_DropsRefsOutsideKeyspaceWithoutFetchingThem(t *testing.T) {
+	inRange := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", Checksum: 1, Bounds: v1.NewBounds(0, 100)}}
+	outOfRange := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", Checksum: 2, Bounds: v1.NewBounds(900, 1000)}}
+	fetcher := &fakeMetaFetcher{
+		refs: []MetaRef{inRange, outOfRange},
+		metas: map[MetaRef]Meta{
+			inRange:    {MetaRef: inRange},
+			outOfRange: {MetaRef: outOfRange},
+		},
+	}
+
+	syncer, err := NewMetaSyncer(MetaSyncerConfig{}, fetcher, "t", "table", v1.NewBounds(0, 500), nil, log.NewNopLogger(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(context.Background()))
+
+	metas, err := syncer.Fetch(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	require.Equal(t, inRange, metas[0].MetaRef)
+	require.EqualValues(t, 1, atomic.LoadInt32(&fetcher.getCalls), "a ref outside the syncer's keyspace must never reach GetMeta")
+}
+
+func TestMetaSyncer_LiveBlocks_ExcludesTombstonedBlocks(t *testing.T) {
+	bounds := v1.NewBounds(0, 100)
+	live := BlockRef{Ref: Ref{TenantID: "t", TableName: "table", Bounds: bounds}}
+	dead := BlockRef{Ref: Ref{TenantID: "t", TableName: "table", Bounds: v1.NewBounds(101, 200)}}
+
+	ref := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", Bounds: bounds}}
+	meta := Meta{MetaRef: ref, Blocks: []BlockRef{live, dead}, BlockTombstones: []BlockRef{dead}}
+	fetcher := &fakeMetaFetcher{
+		refs:  []MetaRef{ref},
+		metas: map[MetaRef]Meta{ref: meta},
+	}
+
+	syncer, err := NewMetaSyncer(MetaSyncerConfig{}, fetcher, "t", "table", fullKeyspace, nil, log.NewNopLogger(), prometheus.NewRegistry())
+	require.NoError(t, err)
+	require.NoError(t, syncer.Sync(context.Background()))
+
+	blocks, err := syncer.LiveBlocks(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []BlockRef{live}, blocks)
+}
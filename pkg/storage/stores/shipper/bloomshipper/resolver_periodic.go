@@ -0,0 +1,180 @@
+package bloomshipper
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/loki/pkg/storage/config"
+)
+
+// keyResolverFactories maps a schema version (config.PeriodConfig.Schema)
+// to the KeyResolver that should be used to lay out objects for periods on
+// that schema. New entries let a rolling schema change migrate to a new
+// object layout (e.g. a hash-prefix shard to spread objects across S3
+// partitions at high object counts) without breaking reads of data written
+// under an older layout.
+var keyResolverFactories = map[string]func() KeyResolver{
+	"v1": func() KeyResolver { return defaultKeyResolver{} },
+}
+
+// RegisterKeyResolver registers factory as the KeyResolver to use for
+// periods whose Schema equals version. It is intended to be called from
+// package init functions that add support for a new bloom object layout.
+func RegisterKeyResolver(version string, factory func() KeyResolver) {
+	keyResolverFactories[version] = factory
+}
+
+// PeriodicKeyResolver dispatches to a per-period KeyResolver based on the
+// schema active at a MetaRef/BlockRef's timestamp, mirroring how Loki's
+// chunk store selects {,Parse}ExternalKey per period.
+type PeriodicKeyResolver struct {
+	periods   []config.PeriodConfig
+	resolvers map[string]KeyResolver
+}
+
+// Compiler check to ensure PeriodicKeyResolver implements KeyResolver
+var _ KeyResolver = &PeriodicKeyResolver{}
+
+// NewPeriodicKeyResolver builds a PeriodicKeyResolver for periods. It
+// returns an error if a period's schema has no registered KeyResolver.
+func NewPeriodicKeyResolver(periods []config.PeriodConfig) (*PeriodicKeyResolver, error) {
+	resolvers := make(map[string]KeyResolver, len(periods))
+	for _, period := range periods {
+		if _, ok := resolvers[period.Schema]; ok {
+			continue
+		}
+		factory, ok := keyResolverFactories[period.Schema]
+		if !ok {
+			return nil, fmt.Errorf("no bloom key resolver registered for schema version %q", period.Schema)
+		}
+		resolvers[period.Schema] = factory()
+	}
+
+	return &PeriodicKeyResolver{periods: periods, resolvers: resolvers}, nil
+}
+
+func (r *PeriodicKeyResolver) resolverFor(ts model.Time) (KeyResolver, error) {
+	period, err := FindPeriod(r.periods, ts)
+	if err != nil {
+		return nil, err
+	}
+	resolver, ok := r.resolvers[period.Schema]
+	if !ok {
+		return nil, fmt.Errorf("no bloom key resolver registered for schema version %q", period.Schema)
+	}
+	return resolver, nil
+}
+
+// oldestResolver returns the KeyResolver for the oldest configured period,
+// used as a fallback when a ref's timestamp predates every configured
+// period's From. That situation is expected during a schema migration, where
+// data retained from before the earliest period must still resolve to a
+// layout -- and the oldest period's is the only one guaranteed to already
+// have been in use when that data was written, so it's the safe choice,
+// unlike the newest period's layout which that data was never written under.
+// It returns false if no periods are configured at all.
+func (r *PeriodicKeyResolver) oldestResolver() (KeyResolver, bool) {
+	if len(r.periods) == 0 {
+		return nil, false
+	}
+	oldest := r.periods[0]
+	for _, period := range r.periods[1:] {
+		if period.From.Time.Before(oldest.From.Time) {
+			oldest = period
+		}
+	}
+	resolver, ok := r.resolvers[oldest.Schema]
+	return resolver, ok
+}
+
+func (r *PeriodicKeyResolver) Meta(ref MetaRef) Location {
+	resolver, err := r.resolverFor(ref.StartTimestamp)
+	if err != nil {
+		// Meta/Block have no error return; fall back to the oldest period's
+		// layout rather than panic on an unresolvable timestamp.
+		if fallback, ok := r.oldestResolver(); ok {
+			resolver = fallback
+		} else {
+			resolver = defaultKeyResolver{}
+		}
+	}
+	return resolver.Meta(ref)
+}
+
+func (r *PeriodicKeyResolver) Block(ref BlockRef) Location {
+	resolver, err := r.resolverFor(ref.StartTimestamp)
+	if err != nil {
+		if fallback, ok := r.oldestResolver(); ok {
+			resolver = fallback
+		} else {
+			resolver = defaultKeyResolver{}
+		}
+	}
+	return resolver.Block(ref)
+}
+
+// ParseMetaKey parses key by trying each configured period's resolver, most
+// recent schema first, since the layout isn't otherwise recoverable from
+// the key alone.
+func (r *PeriodicKeyResolver) ParseMetaKey(key string) (MetaRef, error) {
+	var lastErr error
+	for i := len(r.periods) - 1; i >= 0; i-- {
+		resolver := r.resolvers[r.periods[i].Schema]
+		ref, err := resolver.ParseMetaKey(key)
+		if err == nil {
+			return ref, nil
+		}
+		lastErr = err
+	}
+	return MetaRef{}, fmt.Errorf("no configured resolver could parse meta key %q: %w", key, lastErr)
+}
+
+// ParseBlockKey parses key by trying each configured period's resolver,
+// most recent schema first.
+func (r *PeriodicKeyResolver) ParseBlockKey(key string) (BlockRef, error) {
+	var lastErr error
+	for i := len(r.periods) - 1; i >= 0; i-- {
+		resolver := r.resolvers[r.periods[i].Schema]
+		ref, err := resolver.ParseBlockKey(key)
+		if err == nil {
+			return ref, nil
+		}
+		lastErr = err
+	}
+	return BlockRef{}, fmt.Errorf("no configured resolver could parse block key %q: %w", key, lastErr)
+}
+
+// MetaPrefixes returns the distinct meta listing prefixes across every
+// registered period resolver for tenant/table. Since different schema
+// periods can use different object layouts, a caller that needs to
+// discover every meta object for a tenant/table (e.g. the Cleaner) must
+// list under all of them, not just the default layout.
+func (r *PeriodicKeyResolver) MetaPrefixes(tenant, table string) []string {
+	seen := make(map[string]struct{}, len(r.resolvers))
+	var prefixes []string
+	for _, resolver := range r.resolvers {
+		prefix := resolver.MetaPrefix(tenant, table)
+		if _, ok := seen[prefix]; ok {
+			continue
+		}
+		seen[prefix] = struct{}{}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// BlockPrefixes is the block equivalent of MetaPrefixes.
+func (r *PeriodicKeyResolver) BlockPrefixes(tenant, table string) []string {
+	seen := make(map[string]struct{}, len(r.resolvers))
+	var prefixes []string
+	for _, resolver := range r.resolvers {
+		prefix := resolver.BlockPrefix(tenant, table)
+		if _, ok := seen[prefix]; ok {
+			continue
+		}
+		seen[prefix] = struct{}{}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
@@ -0,0 +1,73 @@
+package bloomshipper
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/loki/pkg/storage/config"
+)
+
+func TestNewPeriodicKeyResolver_UnregisteredSchemaErrors(t *testing.T) {
+	_, err := NewPeriodicKeyResolver([]config.PeriodConfig{
+		{Schema: "does-not-exist", From: config.DayTime{Time: model.TimeFromUnix(0)}},
+	})
+	require.Error(t, err)
+}
+
+func TestPeriodicKeyResolver_ResolverFor(t *testing.T) {
+	periods := []config.PeriodConfig{
+		{Schema: "v1", From: config.DayTime{Time: model.TimeFromUnix(1000)}},
+	}
+	pr, err := NewPeriodicKeyResolver(periods)
+	require.NoError(t, err)
+
+	t.Run("timestamp at or after the period's From resolves", func(t *testing.T) {
+		resolver, err := pr.resolverFor(model.TimeFromUnix(1000))
+		require.NoError(t, err)
+		require.Equal(t, defaultKeyResolver{}, resolver)
+	})
+
+	t.Run("timestamp before every period's From errors", func(t *testing.T) {
+		_, err := pr.resolverFor(model.TimeFromUnix(1))
+		require.Error(t, err)
+	})
+}
+
+func TestPeriodicKeyResolver_OldestResolver(t *testing.T) {
+	t.Run("no periods configured", func(t *testing.T) {
+		pr := &PeriodicKeyResolver{}
+		_, ok := pr.oldestResolver()
+		require.False(t, ok)
+	})
+
+	t.Run("picks the period with the earliest From regardless of slice order", func(t *testing.T) {
+		pr, err := NewPeriodicKeyResolver([]config.PeriodConfig{
+			{Schema: "v1", From: config.DayTime{Time: model.TimeFromUnix(2000)}},
+			{Schema: "v1", From: config.DayTime{Time: model.TimeFromUnix(500)}},
+		})
+		require.NoError(t, err)
+
+		resolver, ok := pr.oldestResolver()
+		require.True(t, ok)
+		require.Equal(t, defaultKeyResolver{}, resolver)
+	})
+}
+
+func TestPeriodicKeyResolver_Meta_FallsBackToOldestPeriodBeforeEveryConfiguredPeriod(t *testing.T) {
+	periods := []config.PeriodConfig{
+		{Schema: "v1", From: config.DayTime{Time: model.TimeFromUnix(1000)}},
+	}
+	pr, err := NewPeriodicKeyResolver(periods)
+	require.NoError(t, err)
+
+	// StartTimestamp predates the only configured period's From, so Meta
+	// must fall back to the oldest resolver instead of erroring or
+	// panicking on the unresolvable timestamp.
+	ref := MetaRef{Ref: Ref{TenantID: "t", TableName: "table", StartTimestamp: model.TimeFromUnix(1)}}
+
+	got := pr.Meta(ref)
+	want := defaultKeyResolver{}.Meta(ref)
+	require.Equal(t, want.Addr(), got.Addr())
+}
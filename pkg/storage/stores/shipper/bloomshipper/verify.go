@@ -0,0 +1,196 @@
+package bloomshipper
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+// BlockVerification controls how thoroughly a downloaded or about-to-be
+// uploaded block is checked before it is trusted.
+type BlockVerification string
+
+const (
+	// BlockVerificationOff performs no verification at all.
+	BlockVerificationOff BlockVerification = "off"
+	// BlockVerificationChecksum verifies the recorded CRC32 checksum of the
+	// block's series/index structure against Ref.Checksum.
+	BlockVerificationChecksum BlockVerification = "checksum"
+	// BlockVerificationFull additionally scans each bloom page for
+	// structural sanity (offset bounds, magic bytes, series bounds within
+	// Ref.Bounds).
+	BlockVerificationFull BlockVerification = "full"
+)
+
+// ErrCorruptBlock is returned by VerifyBlock when a block fails
+// verification. Callers should treat the underlying object as unusable and
+// quarantine it rather than serve stale bloom results from it.
+type ErrCorruptBlock struct {
+	Ref    BlockRef
+	Reason string
+}
+
+func (e *ErrCorruptBlock) Error() string {
+	return fmt.Sprintf("corrupt block %s: %s", e.Ref, e.Reason)
+}
+
+// blockMetadata and bloomPageInfo carry the subset of a *v1.Block's
+// verification-relevant data that verifyChecksum/verifyPages need, decoupled
+// from v1's concrete types so a test can supply a fake verifiableBlock.
+type blockMetadata struct {
+	Checksum uint32
+}
+
+type bloomPageInfo struct {
+	Offset, Len int64
+	Bounds      v1.FingerprintBounds
+	ValidMagic  bool
+}
+
+// verifiableBlock is the subset of *v1.Block that verifyChecksum/verifyPages
+// depend on. BloomClient.openBlock produces one from a BlockDirectory; tests
+// substitute a fake to exercise VerifyBlock's modes without a real block.
+type verifiableBlock interface {
+	Metadata() (blockMetadata, error)
+	BloomPages() ([]bloomPageInfo, error)
+}
+
+// v1BlockAdapter adapts a *v1.Block to verifiableBlock.
+type v1BlockAdapter struct {
+	blk *v1.Block
+}
+
+func (a v1BlockAdapter) Metadata() (blockMetadata, error) {
+	md, err := a.blk.Metadata()
+	if err != nil {
+		return blockMetadata{}, err
+	}
+	return blockMetadata{Checksum: md.Checksum}, nil
+}
+
+func (a v1BlockAdapter) BloomPages() ([]bloomPageInfo, error) {
+	pages, err := a.blk.BloomPages()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]bloomPageInfo, len(pages))
+	for i, p := range pages {
+		out[i] = bloomPageInfo{Offset: p.Offset, Len: p.Len, Bounds: p.Bounds, ValidMagic: p.HasValidMagicNumber()}
+	}
+	return out, nil
+}
+
+type verifyMetrics struct {
+	failures *prometheus.CounterVec
+}
+
+func newVerifyMetrics(r prometheus.Registerer) *verifyMetrics {
+	return &verifyMetrics{
+		failures: promauto.With(r).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "loki",
+			Subsystem: "bloom_store",
+			Name:      "block_verification_failures_total",
+			Help:      "Number of block verification failures, by mode and reason.",
+		}, []string{"mode", "reason"}),
+	}
+}
+
+// VerifyBlock walks dir's v1 block structure and checks it against mode.
+// BlockVerificationOff always succeeds. BlockVerificationChecksum verifies
+// the recorded CRC32 checksum against dir.Ref.Checksum. BlockVerificationFull
+// additionally scans bloom pages for structural sanity.
+//
+// On failure the local extraction at dir.Path is deleted and an
+// *ErrCorruptBlock is returned, so callers quarantine the source object
+// rather than serve from a partially-downloaded or bit-rotted directory.
+func (b *BloomClient) VerifyBlock(_ context.Context, dir BlockDirectory) error {
+	mode := b.verification
+	if mode == BlockVerificationOff || mode == "" {
+		return nil
+	}
+
+	if err := b.verifyChecksum(dir); err != nil {
+		b.verifyMetrics.failures.WithLabelValues(string(mode), "checksum").Inc()
+		_ = os.RemoveAll(dir.Path)
+		return &ErrCorruptBlock{Ref: dir.BlockRef, Reason: err.Error()}
+	}
+
+	if mode == BlockVerificationFull {
+		if err := b.verifyPages(dir); err != nil {
+			b.verifyMetrics.failures.WithLabelValues(string(mode), "structural").Inc()
+			_ = os.RemoveAll(dir.Path)
+			return &ErrCorruptBlock{Ref: dir.BlockRef, Reason: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// verifyChecksum re-derives the checksum of the block's series/index
+// structure and compares it against the checksum recorded on the ref.
+func (b *BloomClient) verifyChecksum(dir BlockDirectory) error {
+	blk := b.openBlock(dir)
+
+	md, err := blk.Metadata()
+	if err != nil {
+		return errors.Wrap(err, "reading block metadata for verification")
+	}
+
+	if md.Checksum != dir.Ref.Checksum {
+		return fmt.Errorf("checksum mismatch: expected %08x, got %08x", dir.Ref.Checksum, md.Checksum)
+	}
+
+	return nil
+}
+
+// verifyPages scans each bloom page recorded in the block's series index,
+// checking offset bounds, the page's magic bytes, and that the page's
+// series bounds fall within dir.Ref.Bounds.
+func (b *BloomClient) verifyPages(dir BlockDirectory) error {
+	blk := b.openBlock(dir)
+
+	pages, err := blk.BloomPages()
+	if err != nil {
+		return errors.Wrap(err, "reading bloom pages for verification")
+	}
+
+	for i, page := range pages {
+		if err := validatePageOffset(page.Offset, page.Len); err != nil {
+			return fmt.Errorf("page %d: %w", i, err)
+		}
+		if !page.ValidMagic {
+			return fmt.Errorf("page %d has an invalid magic number", i)
+		}
+		if err := validatePageBounds(page.Bounds, dir.Ref.Bounds); err != nil {
+			return fmt.Errorf("page %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePageOffset checks that a bloom page's recorded offset and length
+// describe a well-formed, non-empty byte range. Split out from verifyPages
+// so this bounds logic can be unit tested independent of a real v1.Block.
+func validatePageOffset(offset, length int64) error {
+	if length <= 0 || offset < 0 {
+		return fmt.Errorf("invalid offset/length (offset=%d len=%d)", offset, length)
+	}
+	return nil
+}
+
+// validatePageBounds checks that a bloom page's fingerprint bounds fall
+// within the block's own bounds. Split out from verifyPages so this check
+// can be unit tested independent of a real v1.Block.
+func validatePageBounds(page, block v1.FingerprintBounds) error {
+	if !page.Within(block) {
+		return fmt.Errorf("page bounds %s fall outside block bounds %s", page, block)
+	}
+	return nil
+}
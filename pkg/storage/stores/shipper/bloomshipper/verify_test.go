@@ -0,0 +1,159 @@
+package bloomshipper
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	v1 "github.com/grafana/loki/pkg/storage/bloom/v1"
+)
+
+func TestValidatePageOffset(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		offset, length int64
+		wantErr        bool
+	}{
+		{name: "valid", offset: 0, length: 100, wantErr: false},
+		{name: "zero length", offset: 0, length: 0, wantErr: true},
+		{name: "negative length", offset: 0, length: -1, wantErr: true},
+		{name: "negative offset", offset: -1, length: 100, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validatePageOffset(tc.offset, tc.length)
+			if tc.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidatePageBounds(t *testing.T) {
+	block := v1.NewBounds(0, 1000)
+
+	t.Run("page within block bounds", func(t *testing.T) {
+		require.NoError(t, validatePageBounds(v1.NewBounds(100, 200), block))
+	})
+
+	t.Run("page exceeds block bounds", func(t *testing.T) {
+		require.Error(t, validatePageBounds(v1.NewBounds(900, 1100), block))
+	})
+
+	t.Run("page disjoint from block bounds", func(t *testing.T) {
+		require.Error(t, validatePageBounds(v1.NewBounds(2000, 3000), block))
+	})
+}
+
+// fakeVerifiableBlock lets VerifyBlock itself be exercised per mode without
+// a real v1.Block, which this tree has no source to construct.
+type fakeVerifiableBlock struct {
+	md       blockMetadata
+	pages    []bloomPageInfo
+	pagesErr error
+}
+
+func (f fakeVerifiableBlock) Metadata() (blockMetadata, error) { return f.md, nil }
+func (f fakeVerifiableBlock) BloomPages() ([]bloomPageInfo, error) {
+	return f.pages, f.pagesErr
+}
+
+func verifyTestClient(mode BlockVerification, blk fakeVerifiableBlock) *BloomClient {
+	return &BloomClient{
+		logger:        log.NewNopLogger(),
+		verification:  mode,
+		verifyMetrics: newVerifyMetrics(prometheus.NewRegistry()),
+		openBlock:     func(BlockDirectory) verifiableBlock { return blk },
+	}
+}
+
+func testVerifyDir(t *testing.T, bounds v1.FingerprintBounds, checksum uint32) BlockDirectory {
+	t.Helper()
+	ref := BlockRef{Ref: Ref{TenantID: "t", TableName: "table", Bounds: bounds, Checksum: checksum}}
+	return NewBlockDirectory(ref, t.TempDir(), log.NewNopLogger())
+}
+
+func TestVerifyBlock_Off_NeverConsultsTheBlock(t *testing.T) {
+	dir := testVerifyDir(t, v1.NewBounds(0, 100), 1)
+	b := verifyTestClient(BlockVerificationOff, fakeVerifiableBlock{pagesErr: errCorruptSentinel})
+	require.NoError(t, b.VerifyBlock(context.Background(), dir))
+}
+
+func TestVerifyBlock_Checksum_MismatchIsCorrupt(t *testing.T) {
+	dir := testVerifyDir(t, v1.NewBounds(0, 100), 42)
+	b := verifyTestClient(BlockVerificationChecksum, fakeVerifiableBlock{md: blockMetadata{Checksum: 7}})
+
+	err := b.VerifyBlock(context.Background(), dir)
+	require.Error(t, err)
+	var corrupt *ErrCorruptBlock
+	require.ErrorAs(t, err, &corrupt)
+
+	_, statErr := os.Stat(dir.Path)
+	require.True(t, os.IsNotExist(statErr), "a failed verification must delete the local extraction")
+}
+
+func TestVerifyBlock_Checksum_MatchSucceeds(t *testing.T) {
+	dir := testVerifyDir(t, v1.NewBounds(0, 100), 42)
+	b := verifyTestClient(BlockVerificationChecksum, fakeVerifiableBlock{md: blockMetadata{Checksum: 42}})
+	require.NoError(t, b.VerifyBlock(context.Background(), dir))
+}
+
+func TestVerifyBlock_Checksum_DoesNotScanPages(t *testing.T) {
+	dir := testVerifyDir(t, v1.NewBounds(0, 100), 42)
+	b := verifyTestClient(BlockVerificationChecksum, fakeVerifiableBlock{
+		md:       blockMetadata{Checksum: 42},
+		pagesErr: errCorruptSentinel,
+	})
+	require.NoError(t, b.VerifyBlock(context.Background(), dir), "checksum mode must not scan pages even if doing so would fail")
+}
+
+func TestVerifyBlock_Full_BadPageOffsetIsCorrupt(t *testing.T) {
+	bounds := v1.NewBounds(0, 100)
+	dir := testVerifyDir(t, bounds, 42)
+	b := verifyTestClient(BlockVerificationFull, fakeVerifiableBlock{
+		md:    blockMetadata{Checksum: 42},
+		pages: []bloomPageInfo{{Offset: 0, Len: 0, Bounds: bounds, ValidMagic: true}},
+	})
+	require.Error(t, b.VerifyBlock(context.Background(), dir))
+}
+
+func TestVerifyBlock_Full_InvalidMagicNumberIsCorrupt(t *testing.T) {
+	bounds := v1.NewBounds(0, 100)
+	dir := testVerifyDir(t, bounds, 42)
+	b := verifyTestClient(BlockVerificationFull, fakeVerifiableBlock{
+		md:    blockMetadata{Checksum: 42},
+		pages: []bloomPageInfo{{Offset: 0, Len: 10, Bounds: bounds, ValidMagic: false}},
+	})
+	require.Error(t, b.VerifyBlock(context.Background(), dir))
+}
+
+func TestVerifyBlock_Full_PageOutsideBlockBoundsIsCorrupt(t *testing.T) {
+	bounds := v1.NewBounds(0, 100)
+	dir := testVerifyDir(t, bounds, 42)
+	b := verifyTestClient(BlockVerificationFull, fakeVerifiableBlock{
+		md:    blockMetadata{Checksum: 42},
+		pages: []bloomPageInfo{{Offset: 0, Len: 10, Bounds: v1.NewBounds(900, 1000), ValidMagic: true}},
+	})
+	require.Error(t, b.VerifyBlock(context.Background(), dir))
+}
+
+func TestVerifyBlock_Full_AllPagesValidSucceeds(t *testing.T) {
+	bounds := v1.NewBounds(0, 100)
+	dir := testVerifyDir(t, bounds, 42)
+	b := verifyTestClient(BlockVerificationFull, fakeVerifiableBlock{
+		md: blockMetadata{Checksum: 42},
+		pages: []bloomPageInfo{
+			{Offset: 0, Len: 10, Bounds: v1.NewBounds(0, 50), ValidMagic: true},
+			{Offset: 10, Len: 10, Bounds: v1.NewBounds(51, 100), ValidMagic: true},
+		},
+	})
+	require.NoError(t, b.VerifyBlock(context.Background(), dir))
+}
+
+var errCorruptSentinel = errors.New("fake: bloom pages unreadable")